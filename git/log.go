@@ -0,0 +1,227 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// logFormat pulls exactly the fields Commit needs out of `git log`, each
+// terminated by a NUL so a commit with an empty field (an initial commit
+// with no parent, say) doesn't shift the rest out of alignment.
+const logFormat = "%H%x00%P%x00%T%x00%an%x00%ae%x00%aI%x00%cn%x00%ce%x00%cI%x00%s%x00%b%x00"
+
+// logFieldsPerCommit is the number of %x00-terminated fields logFormat
+// produces per commit.
+const logFieldsPerCommit = 11
+
+// MergesFilter controls whether Log/Walk include merge commits.
+type MergesFilter int
+
+const (
+	// AnyMerges includes both merge and non-merge commits.
+	AnyMerges MergesFilter = iota
+	// NoMerges excludes merge commits, as `git log --no-merges` does.
+	NoMerges
+	// OnlyMerges shows only merge commits, as `git log --merges` does.
+	OnlyMerges
+)
+
+// LogSpec describes a commit history query, mirroring the options `git
+// log` itself supports.
+type LogSpec struct {
+	// Since and Until bound the revision range: Since..Until. Either may
+	// be nil; Since nil means "from the beginning of history", Until nil
+	// means "through HEAD".
+	Since, Until *Ref
+	Paths        []string
+	Author       string
+	Grep         string
+	MaxCount     int
+	FirstParent  bool
+	Reverse      bool
+	Merges       MergesFilter
+}
+
+func (spec LogSpec) args() []string {
+	args := []string{"-z", "--format=" + logFormat}
+	if spec.MaxCount > 0 {
+		args = append(args, fmt.Sprintf("--max-count=%d", spec.MaxCount))
+	}
+	if spec.FirstParent {
+		args = append(args, "--first-parent")
+	}
+	if spec.Reverse {
+		args = append(args, "--reverse")
+	}
+	switch spec.Merges {
+	case NoMerges:
+		args = append(args, "--no-merges")
+	case OnlyMerges:
+		args = append(args, "--merges")
+	}
+	if spec.Author != "" {
+		args = append(args, "--author="+spec.Author)
+	}
+	if spec.Grep != "" {
+		args = append(args, "--grep="+spec.Grep)
+	}
+	var rangeArg string
+	switch {
+	case spec.Since != nil && spec.Until != nil:
+		rangeArg = fmt.Sprintf("%s..%s", spec.Since.SHA, spec.Until.SHA)
+	case spec.Since != nil:
+		rangeArg = fmt.Sprintf("%s..", spec.Since.SHA)
+	case spec.Until != nil:
+		rangeArg = string(spec.Until.SHA)
+	}
+	if rangeArg != "" {
+		args = append(args, rangeArg)
+	}
+	if len(spec.Paths) > 0 {
+		args = append(args, "--")
+		args = append(args, spec.Paths...)
+	}
+	return args
+}
+
+// Log runs spec and returns every matching commit. For histories too large
+// to hold comfortably in memory, use Walk instead.
+func (r *Repo) Log(spec LogSpec) (commits []*Commit, err error) {
+	err = r.Walk(spec, func(c *Commit) error {
+		commits = append(commits, c)
+		return nil
+	})
+	return
+}
+
+// Walk runs spec and calls fn with each matching commit in turn, streaming
+// `git log`'s output instead of buffering it, so walking a million-commit
+// repo doesn't require holding it all in memory at once. Returning an error
+// from fn stops the walk and that error is returned from Walk.
+func (r *Repo) Walk(spec LogSpec, fn func(*Commit) error) error {
+	cmd, _, stderr := r.Git("log", spec.args()...)
+	cmd.Stdout = nil
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	scanner.Split(splitNUL)
+
+	fields := make([]string, 0, logFieldsPerCommit)
+	var walkErr error
+	for scanner.Scan() {
+		tok := scanner.Text()
+		if tok == "" && len(fields) == 0 {
+			continue // the extra record-terminating NUL that -z adds
+		}
+		fields = append(fields, tok)
+		if len(fields) < logFieldsPerCommit {
+			continue
+		}
+		c, perr := parseLogFields(fields)
+		fields = fields[:0]
+		if perr != nil {
+			walkErr = perr
+			break
+		}
+		if err := fn(c); err != nil {
+			walkErr = err
+			break
+		}
+	}
+	if walkErr == nil {
+		walkErr = scanner.Err()
+	}
+	if walkErr != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return walkErr
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("git log: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// splitNUL is a bufio.SplitFunc that splits on NUL bytes instead of
+// newlines, for scanning the -z-delimited output of `git log`.
+func splitNUL(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// parseLogFields turns one logFormat record into a Commit.
+func parseLogFields(f []string) (*Commit, error) {
+	c := &Commit{OID: ObjectID(f[0]), Tree: ObjectID(f[2])}
+	if f[1] != "" {
+		for _, p := range strings.Fields(f[1]) {
+			c.Parents = append(c.Parents, ObjectID(p))
+		}
+	}
+	authorWhen, err := time.Parse(time.RFC3339, f[5])
+	if err != nil {
+		return nil, fmt.Errorf("malformed author date %q on commit %s: %v", f[5], f[0], err)
+	}
+	c.Author = Signature{Name: f[3], Email: f[4], When: authorWhen}
+
+	committerWhen, err := time.Parse(time.RFC3339, f[8])
+	if err != nil {
+		return nil, fmt.Errorf("malformed committer date %q on commit %s: %v", f[8], f[0], err)
+	}
+	c.Committer = Signature{Name: f[6], Email: f[7], When: committerWhen}
+
+	c.Subject = f[9]
+	c.Body, c.Trailers = splitTrailers(f[10])
+	return c, nil
+}
+
+// trailerRE matches a single "Key: value" trailer line (Signed-off-by,
+// Co-authored-by, and so on).
+var trailerRE = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9-]*): (.+)$`)
+
+// splitTrailers pulls a trailing block of "Key: value" lines off the end
+// of a commit message body, returning the remaining body and the parsed
+// trailers (nil if there is no trailer block).
+func splitTrailers(body string) (string, map[string][]string) {
+	body = strings.TrimRight(body, "\n")
+	if body == "" {
+		return "", nil
+	}
+	lines := strings.Split(body, "\n")
+	end := len(lines)
+	start := end
+	for start > 0 && trailerRE.MatchString(lines[start-1]) {
+		start--
+	}
+	if start == end {
+		return body, nil
+	}
+	if start > 0 && strings.TrimSpace(lines[start-1]) != "" {
+		return body, nil // not a standalone trailer paragraph
+	}
+	trailers := make(map[string][]string)
+	for _, line := range lines[start:] {
+		m := trailerRE.FindStringSubmatch(line)
+		trailers[m[1]] = append(trailers[m[1]], m[2])
+	}
+	rest := strings.TrimRight(strings.Join(lines[:start], "\n"), "\n")
+	return rest, trailers
+}
@@ -0,0 +1,303 @@
+package git
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncResult summarizes what a single remote's Mirror.SyncAll fetch
+// changed: which refs appeared or vanished, and how many commits each
+// updated ref gained.
+type SyncResult struct {
+	Remote       string
+	NewRefs      []string
+	RemovedRefs  []string
+	CommitsAdded map[string]int
+	Err          error
+}
+
+type inflightSync struct {
+	done chan struct{}
+	res  SyncResult
+}
+
+// Mirror manages a bare Repo as a many-remote mirror: a set of upstream
+// remotes that can be fetched independently and concurrently, with
+// structured reporting of what each fetch changed.
+type Mirror struct {
+	*Repo
+
+	mu       sync.Mutex
+	remotes  map[string]string
+	inFlight map[string]*inflightSync
+}
+
+// NewMirror opens the bare repository at dir, initializing one there with
+// `git init --bare` if dir does not exist or does not hold a repository
+// yet.
+func NewMirror(dir string) (*Mirror, error) {
+	var repo *Repo
+	var err error
+	if _, statErr := os.Stat(dir); statErr != nil {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		repo, err = Init(dir, "--bare")
+	} else if repo, err = Open(dir); err != nil {
+		repo, err = Init(dir, "--bare")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !repo.IsRaw() {
+		return nil, fmt.Errorf("%s is not a bare repository", dir)
+	}
+	return &Mirror{
+		Repo:     repo,
+		remotes:  make(map[string]string),
+		inFlight: make(map[string]*inflightSync),
+	}, nil
+}
+
+// AddOrigin registers name as a remote to mirror, or repoints it at url if
+// it is already registered.
+func (m *Mirror) AddOrigin(name, url string) error {
+	m.mu.Lock()
+	_, exists := m.remotes[name]
+	m.mu.Unlock()
+
+	if exists {
+		c, _, stderr := m.Git("remote", "set-url", name, url)
+		if err := c.Run(); err != nil {
+			return fmt.Errorf("remote set-url %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+		}
+	} else {
+		c, _, stderr := m.Git("remote", "add", name, url)
+		if err := c.Run(); err != nil {
+			return fmt.Errorf("remote add %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+		}
+	}
+
+	m.mu.Lock()
+	m.remotes[name] = url
+	m.mu.Unlock()
+	return nil
+}
+
+// SyncAll fetches every registered remote concurrently and reports the
+// result of each.
+func (m *Mirror) SyncAll(ctx context.Context) (map[string]SyncResult, error) {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.remotes))
+	for name := range m.remotes {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+
+	results := make(map[string]SyncResult, len(names))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			res := m.syncRemoteDeduped(ctx, name)
+			mu.Lock()
+			results[name] = res
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// syncRemoteDeduped makes sure that only one fetch of a given remote runs
+// at a time: a caller that arrives while a fetch is already in flight waits
+// for it and shares its result, rather than starting a second redundant
+// fetch.
+func (m *Mirror) syncRemoteDeduped(ctx context.Context, name string) SyncResult {
+	m.mu.Lock()
+	if existing, ok := m.inFlight[name]; ok {
+		m.mu.Unlock()
+		<-existing.done
+		return existing.res
+	}
+	infl := &inflightSync{done: make(chan struct{})}
+	m.inFlight[name] = infl
+	m.mu.Unlock()
+
+	res := m.syncRemote(ctx, name)
+
+	m.mu.Lock()
+	delete(m.inFlight, name)
+	m.mu.Unlock()
+	infl.res = res
+	close(infl.done)
+	return res
+}
+
+// syncRemote actually runs the fetch for name, retrying transient network
+// failures with exponential backoff, and diffs the before/after ref
+// snapshots to build a SyncResult.
+func (m *Mirror) syncRemote(ctx context.Context, name string) SyncResult {
+	res := SyncResult{Remote: name, CommitsAdded: make(map[string]int)}
+	prefix := "refs/remotes/" + name + "/"
+	before := m.refSnapshot(prefix)
+
+	args := []string{
+		"--prune", "--no-tags", name,
+		fmt.Sprintf("+refs/heads/*:refs/remotes/%s/heads/*", name),
+		fmt.Sprintf("+refs/tags/*:refs/remotes/%s/tags/*", name),
+	}
+
+	backoff := time.Second
+	var lastErr error
+	for attempt := 0; attempt < 5; attempt++ {
+		cmd, _, stderr := m.GitContext(ctx, "fetch", args...)
+		if err := cmd.Run(); err != nil {
+			lastErr = fmt.Errorf("fetch %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+			if !isTransientFetchErr(lastErr) {
+				break
+			}
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+				continue
+			case <-ctx.Done():
+				res.Err = ctx.Err()
+				return res
+			}
+		}
+		lastErr = nil
+		break
+	}
+	if lastErr != nil {
+		res.Err = lastErr
+		return res
+	}
+
+	m.ReloadRefs()
+	after := m.refSnapshot(prefix)
+	for ref, sha := range after {
+		oldSHA, existed := before[ref]
+		if !existed {
+			res.NewRefs = append(res.NewRefs, ref)
+			continue
+		}
+		if oldSHA == sha {
+			continue
+		}
+		cmd, out, _ := m.Git("rev-list", "--count", oldSHA+".."+sha)
+		if cmd.Run() == nil {
+			if n, err := strconv.Atoi(strings.TrimSpace(out.String())); err == nil {
+				res.CommitsAdded[ref] = n
+			}
+		}
+	}
+	for ref := range before {
+		if _, ok := after[ref]; !ok {
+			res.RemovedRefs = append(res.RemovedRefs, ref)
+		}
+	}
+	sort.Strings(res.NewRefs)
+	sort.Strings(res.RemovedRefs)
+	return res
+}
+
+// refSnapshot maps every ref under prefix to the SHA it currently points
+// at, by scanning `git show-ref` directly rather than going through the
+// (possibly stale) cached RefMap.
+func (m *Mirror) refSnapshot(prefix string) map[string]string {
+	snap := make(map[string]string)
+	cmd, out, _ := m.Git("show-ref")
+	cmd.Run() // show-ref exits non-zero on an empty repo; that's fine here.
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[1], prefix) {
+			snap[parts[1]] = parts[0]
+		}
+	}
+	return snap
+}
+
+// isTransientFetchErr guesses whether a fetch failure is a transient
+// network blip worth retrying, as opposed to something retrying won't fix
+// (bad credentials, unknown remote, rejected ref).
+func isTransientFetchErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, marker := range []string{
+		"could not resolve host",
+		"connection reset",
+		"connection refused",
+		"connection timed out",
+		"timed out",
+		"temporary failure",
+		"network is unreachable",
+		"tls handshake",
+		"eof",
+	} {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Push pushes refspecs (or the remote's configured defaults, if none are
+// given) to name.
+func (m *Mirror) Push(name string, refspecs ...string) error {
+	args := append([]string{name}, refspecs...)
+	cmd, _, stderr := m.Git("push", args...)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("push %s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// ServeArchive streams `git archive` for rev as an HTTP response, so a
+// Mirror can double as a tarball/zipball server for downstream build
+// systems. format is "tar.gz" or "zip".
+func (m *Mirror) ServeArchive(w http.ResponseWriter, req *http.Request, rev, format string) {
+	var gitFormat string
+	switch format {
+	case "zip":
+		gitFormat = "zip"
+		w.Header().Set("Content-Type", "application/zip")
+	case "tar.gz":
+		gitFormat = "tar"
+		w.Header().Set("Content-Type", "application/gzip")
+	default:
+		http.Error(w, fmt.Sprintf("unsupported archive format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	cmd, _, stderr := m.GitContext(req.Context(), "archive", "--format="+gitFormat, "--", rev)
+	var out io.Writer = w
+	var gz *gzip.Writer
+	if format == "tar.gz" {
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	cmd.Stdout = out
+	if err := cmd.Run(); err != nil {
+		http.Error(w, strings.TrimSpace(stderr.String()), http.StatusInternalServerError)
+		return
+	}
+	if gz != nil {
+		gz.Close()
+	}
+}
@@ -0,0 +1,310 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TreeEntry is one line of a tree object: a mode, a name, and the object it
+// points at (a blob, or another tree for subdirectories).
+type TreeEntry struct {
+	Mode string
+	Name string
+	OID  ObjectID
+}
+
+// Signature is the name, email, and timestamp attached to a commit's author
+// or committer line.
+type Signature struct {
+	Name, Email string
+	When        time.Time
+}
+
+// Commit is a parsed commit object.
+type Commit struct {
+	OID       ObjectID
+	Parents   []ObjectID
+	Tree      ObjectID
+	Author    Signature
+	Committer Signature
+	Subject   string
+	Body      string
+	// Trailers holds the commit message's trailing "Key: value" block
+	// (Signed-off-by, Co-authored-by, and the like), keyed by trailer name
+	// with values in the order they appeared. It is nil if the message has
+	// no trailer block.
+	Trailers map[string][]string
+}
+
+// ObjectDB gives direct, in-process access to a repository's object store
+// (loose objects and packs), without shelling out to git for every object
+// read. Repo.Git remains available as a fallback for anything ObjectDB does
+// not implement natively.
+type ObjectDB struct {
+	repo       *Repo
+	objectsDir string
+	packs      []*packFile
+}
+
+// ObjectDB opens this repo's on-disk object store. It reads every pack index
+// into memory up front (each pack file itself is opened per object read),
+// so callers scanning many objects should keep it around rather than calling
+// ObjectDB() repeatedly.
+func (r *Repo) ObjectDB() (db *ObjectDB, err error) {
+	objectsDir := filepath.Join(r.GitDir, "objects")
+	if _, err = os.Stat(objectsDir); err != nil {
+		return nil, fmt.Errorf("no object store at %s: %v", objectsDir, err)
+	}
+	db = &ObjectDB{repo: r, objectsDir: objectsDir}
+	packDir := filepath.Join(objectsDir, "pack")
+	entries, err := ioutil.ReadDir(packDir)
+	if err != nil {
+		// No pack directory is fine; the repo may only have loose objects.
+		return db, nil
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".idx") {
+			continue
+		}
+		base := strings.TrimSuffix(entry.Name(), ".idx")
+		pf, err := openPackFile(filepath.Join(packDir, base+".idx"), filepath.Join(packDir, base+".pack"), r.HashAlgo.HexSize()/2)
+		if err != nil {
+			return nil, err
+		}
+		db.packs = append(db.packs, pf)
+	}
+	return db, nil
+}
+
+func (db *ObjectDB) loosePath(oid ObjectID) string {
+	s := string(oid)
+	return filepath.Join(db.objectsDir, s[:2], s[2:])
+}
+
+// readRaw returns the type ("blob", "tree", "commit", or "tag") and
+// decompressed content of oid, trying loose storage first and then every
+// open pack.
+func (db *ObjectDB) readRaw(oid ObjectID) (objType string, content []byte, err error) {
+	if objType, content, err = db.readLoose(oid); err == nil {
+		return
+	}
+	for _, pf := range db.packs {
+		if objType, content, err = pf.readObject(oid); err == nil {
+			return
+		}
+	}
+	return "", nil, fmt.Errorf("object %s not found", oid)
+}
+
+func (db *ObjectDB) readLoose(oid ObjectID) (objType string, content []byte, err error) {
+	f, err := os.Open(db.loosePath(oid))
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	zr, err := zlib.NewReader(f)
+	if err != nil {
+		return "", nil, err
+	}
+	defer zr.Close()
+	raw, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return "", nil, err
+	}
+	nul := bytes.IndexByte(raw, 0)
+	if nul < 0 {
+		return "", nil, fmt.Errorf("malformed loose object %s: no header terminator", oid)
+	}
+	header := strings.SplitN(string(raw[:nul]), " ", 2)
+	if len(header) != 2 {
+		return "", nil, fmt.Errorf("malformed loose object %s: bad header %q", oid, raw[:nul])
+	}
+	return header[0], raw[nul+1:], nil
+}
+
+// Blob returns a reader over oid's content along with its size. The whole
+// object is inflated into memory before Blob returns. The caller must Close
+// the returned reader.
+func (db *ObjectDB) Blob(oid ObjectID) (rc io.ReadCloser, size int64, err error) {
+	objType, content, err := db.readRaw(oid)
+	if err != nil {
+		return nil, 0, err
+	}
+	if objType != "blob" {
+		return nil, 0, fmt.Errorf("%s is a %s, not a blob", oid, objType)
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), int64(len(content)), nil
+}
+
+// Tree parses oid's tree entries.
+func (db *ObjectDB) Tree(oid ObjectID) (entries []TreeEntry, err error) {
+	objType, content, err := db.readRaw(oid)
+	if err != nil {
+		return nil, err
+	}
+	if objType != "tree" {
+		return nil, fmt.Errorf("%s is a %s, not a tree", oid, objType)
+	}
+	hashBytes := db.repo.HashAlgo.HexSize() / 2
+	for len(content) > 0 {
+		sp := bytes.IndexByte(content, ' ')
+		if sp < 0 {
+			return nil, fmt.Errorf("malformed tree %s: missing mode separator", oid)
+		}
+		mode := string(content[:sp])
+		content = content[sp+1:]
+		nul := bytes.IndexByte(content, 0)
+		if nul < 0 {
+			return nil, fmt.Errorf("malformed tree %s: missing name terminator", oid)
+		}
+		name := string(content[:nul])
+		content = content[nul+1:]
+		if len(content) < hashBytes {
+			return nil, fmt.Errorf("malformed tree %s: truncated entry hash", oid)
+		}
+		entries = append(entries, TreeEntry{Mode: mode, Name: name, OID: ObjectID(fmt.Sprintf("%x", content[:hashBytes]))})
+		content = content[hashBytes:]
+	}
+	return entries, nil
+}
+
+// Commit parses oid's commit headers and message.
+func (db *ObjectDB) Commit(oid ObjectID) (*Commit, error) {
+	objType, content, err := db.readRaw(oid)
+	if err != nil {
+		return nil, err
+	}
+	if objType != "commit" {
+		return nil, fmt.Errorf("%s is a %s, not a commit", oid, objType)
+	}
+	c := &Commit{OID: oid}
+	lines := strings.Split(string(content), "\n")
+	i := 0
+	for ; i < len(lines) && lines[i] != ""; i++ {
+		parts := strings.SplitN(lines[i], " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], parts[1]
+		switch key {
+		case "tree":
+			c.Tree = ObjectID(value)
+		case "parent":
+			c.Parents = append(c.Parents, ObjectID(value))
+		case "author":
+			c.Author = parseSignature(value)
+		case "committer":
+			c.Committer = parseSignature(value)
+		}
+	}
+	if i < len(lines) {
+		i++ // skip the blank line separating headers from the message
+	}
+	message := strings.Join(lines[i:], "\n")
+	if idx := strings.Index(message, "\n\n"); idx >= 0 {
+		c.Subject, c.Body = message[:idx], message[idx+2:]
+	} else {
+		c.Subject = strings.TrimRight(message, "\n")
+	}
+	c.Body, c.Trailers = splitTrailers(c.Body)
+	return c, nil
+}
+
+// parseSignature parses a "Name <email> <unix-seconds> <tz-offset>" line as
+// found on a commit's author/committer headers.
+func parseSignature(line string) (sig Signature) {
+	lt := strings.LastIndex(line, "<")
+	gt := strings.LastIndex(line, ">")
+	if lt < 0 || gt < lt {
+		return Signature{Name: line}
+	}
+	sig.Name = strings.TrimSpace(line[:lt])
+	sig.Email = line[lt+1 : gt]
+	rest := strings.Fields(line[gt+1:])
+	if len(rest) != 2 {
+		return sig
+	}
+	secs, err := strconv.ParseInt(rest[0], 10, 64)
+	if err != nil {
+		return sig
+	}
+	loc := parseTZOffset(rest[1])
+	sig.When = time.Unix(secs, 0).In(loc)
+	return sig
+}
+
+func parseTZOffset(tz string) *time.Location {
+	if len(tz) != 5 {
+		return time.UTC
+	}
+	sign := 1
+	if tz[0] == '-' {
+		sign = -1
+	}
+	hours, err1 := strconv.Atoi(tz[1:3])
+	mins, err2 := strconv.Atoi(tz[3:5])
+	if err1 != nil || err2 != nil {
+		return time.UTC
+	}
+	return time.FixedZone(tz, sign*(hours*3600+mins*60))
+}
+
+// WriteBlob hashes and writes r's contents as a loose blob object, returning
+// the resulting ObjectID.
+func (db *ObjectDB) WriteBlob(r io.Reader) (ObjectID, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	header := fmt.Sprintf("blob %d\x00", len(content))
+	raw := append([]byte(header), content...)
+	var oid ObjectID
+	if db.repo.HashAlgo == SHA256 {
+		oid = ObjectID(fmt.Sprintf("%x", sha256.Sum256(raw)))
+	} else {
+		oid = ObjectID(fmt.Sprintf("%x", sha1.Sum(raw)))
+	}
+
+	path := db.loosePath(oid)
+	if _, err := os.Stat(path); err == nil {
+		return oid, nil // already present
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp-obj-")
+	if err != nil {
+		return "", err
+	}
+	zw := zlib.NewWriter(tmp)
+	if _, err := zw.Write(raw); err != nil {
+		zw.Close()
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return oid, nil
+}
@@ -0,0 +1,72 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestObjectDB(t *testing.T) *ObjectDB {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "objectdb-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := (&Repo{GitDir: dir}).ObjectDB()
+	if err != nil {
+		t.Fatalf("ObjectDB: %v", err)
+	}
+	return db
+}
+
+func TestWriteBlobAndReadBack(t *testing.T) {
+	db := newTestObjectDB(t)
+
+	want := []byte("hello, object database\n")
+	oid, err := db.WriteBlob(bytes.NewReader(want))
+	if err != nil {
+		t.Fatalf("WriteBlob: %v", err)
+	}
+	if !oid.Valid() {
+		t.Fatalf("WriteBlob returned an invalid object id %q", oid)
+	}
+
+	rc, size, err := db.Blob(oid)
+	if err != nil {
+		t.Fatalf("Blob: %v", err)
+	}
+	defer rc.Close()
+	if size != int64(len(want)) {
+		t.Errorf("size = %d, want %d", size, len(want))
+	}
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading blob: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("blob content = %q, want %q", got, want)
+	}
+}
+
+func TestWriteBlobIsIdempotent(t *testing.T) {
+	db := newTestObjectDB(t)
+
+	content := []byte("same content twice")
+	first, err := db.WriteBlob(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("first WriteBlob: %v", err)
+	}
+	second, err := db.WriteBlob(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("second WriteBlob: %v", err)
+	}
+	if first != second {
+		t.Errorf("WriteBlob returned different ids for identical content: %s != %s", first, second)
+	}
+}
@@ -0,0 +1,55 @@
+package git
+
+import "regexp"
+
+// SHA1HexSize and SHA256HexSize are the hex-encoded lengths of the two
+// object id formats Git supports.
+const (
+	SHA1HexSize   = 40
+	SHA256HexSize = 64
+)
+
+// ObjectIDLengths holds the hex lengths of every object id format this
+// package understands, in the order Git introduced them.
+var ObjectIDLengths = []int{SHA1HexSize, SHA256HexSize}
+
+// ObjectIDRegex matches a full, untruncated object id under either hash
+// algorithm.
+var ObjectIDRegex = regexp.MustCompile(`^([0-9a-fA-F]{40}|[0-9a-fA-F]{64})$`)
+
+// ObjectID is a Git object id: a hex-encoded hash. It is a thin wrapper
+// around string so that ref/rev-parse code stops assuming every id is 40
+// characters wide.
+type ObjectID string
+
+// Valid reports whether id is a full object id under one of the known hash
+// algorithms.
+func (id ObjectID) Valid() bool {
+	return ObjectIDRegex.MatchString(string(id))
+}
+
+// String implements fmt.Stringer.
+func (id ObjectID) String() string {
+	return string(id)
+}
+
+// HashAlgo identifies which hash algorithm a repository's object database
+// was created with.
+type HashAlgo int
+
+const (
+	// SHA1 is Git's original, and still default, hash algorithm.
+	SHA1 HashAlgo = iota
+	// SHA256 is used by repositories initialized with
+	// `--object-format=sha256` or an `extensions.objectFormat = sha256`
+	// config entry.
+	SHA256
+)
+
+// HexSize returns the hex-encoded object id length that algo produces.
+func (a HashAlgo) HexSize() int {
+	if a == SHA256 {
+		return SHA256HexSize
+	}
+	return SHA1HexSize
+}
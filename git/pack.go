@@ -0,0 +1,345 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Pack object type tags, as stored in the three type bits of a packed
+// object's header byte.
+const (
+	packObjCommit   = 1
+	packObjTree     = 2
+	packObjBlob     = 3
+	packObjTag      = 4
+	packObjOfsDelta = 6
+	packObjRefDelta = 7
+)
+
+var packTypeNames = map[int]string{
+	packObjCommit: "commit",
+	packObjTree:   "tree",
+	packObjBlob:   "blob",
+	packObjTag:    "tag",
+}
+
+// packFile is a single pack and its v2 index, memory-mapped-ish via a plain
+// read: the index is small enough to hold entirely in memory, and the pack
+// itself is read object-by-object with os.File.ReadAt.
+type packFile struct {
+	packPath string
+	idSize   int // bytes per object id: 20 for SHA-1, 32 for SHA-256
+	fanout   [256]uint32
+	shas     [][]byte
+	offsets  []uint64
+}
+
+func openPackFile(idxPath, packPath string, idSize int) (*packFile, error) {
+	raw, err := ioutil.ReadFile(idxPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 8 || !bytes.Equal(raw[:4], []byte{0xff, 't', 'O', 'c'}) {
+		return nil, fmt.Errorf("%s: not a version 2 pack index", idxPath)
+	}
+	version := binary.BigEndian.Uint32(raw[4:8])
+	if version != 2 {
+		return nil, fmt.Errorf("%s: unsupported pack index version %d", idxPath, version)
+	}
+	pf := &packFile{packPath: packPath, idSize: idSize}
+	off := 8
+	for i := 0; i < 256; i++ {
+		pf.fanout[i] = binary.BigEndian.Uint32(raw[off : off+4])
+		off += 4
+	}
+	n := int(pf.fanout[255])
+	pf.shas = make([][]byte, n)
+	for i := 0; i < n; i++ {
+		sha := make([]byte, idSize)
+		copy(sha, raw[off:off+idSize])
+		pf.shas[i] = sha
+		off += idSize
+	}
+	off += n * 4 // CRC32 table, not needed for reads
+	smallOffsets := raw[off : off+n*4]
+	off += n * 4
+	var bigOffsetsUsed int
+	for i := 0; i < n; i++ {
+		v := binary.BigEndian.Uint32(smallOffsets[i*4 : i*4+4])
+		if v&0x80000000 != 0 {
+			bigOffsetsUsed++
+		}
+	}
+	bigOffsets := raw[off : off+bigOffsetsUsed*8]
+	pf.offsets = make([]uint64, n)
+	bigIdx := 0
+	for i := 0; i < n; i++ {
+		v := binary.BigEndian.Uint32(smallOffsets[i*4 : i*4+4])
+		if v&0x80000000 != 0 {
+			pf.offsets[i] = binary.BigEndian.Uint64(bigOffsets[bigIdx*8 : bigIdx*8+8])
+			bigIdx++
+		} else {
+			pf.offsets[i] = uint64(v)
+		}
+	}
+	return pf, nil
+}
+
+// find returns the index into pf.shas/pf.offsets for oid, or -1.
+func (pf *packFile) find(oid ObjectID) int {
+	want, err := hex.DecodeString(string(oid))
+	if err != nil || len(want) != pf.idSize {
+		return -1
+	}
+	lo, hi := 0, len(pf.shas)
+	if want[0] > 0 {
+		lo = int(pf.fanout[want[0]-1])
+	}
+	hi = int(pf.fanout[want[0]])
+	for i := lo; i < hi; i++ {
+		if bytes.Equal(pf.shas[i], want) {
+			return i
+		}
+	}
+	return -1
+}
+
+// readObject resolves oid against this pack, inflating and applying any
+// delta chain needed to reconstruct the full object.
+func (pf *packFile) readObject(oid ObjectID) (objType string, content []byte, err error) {
+	idx := pf.find(oid)
+	if idx < 0 {
+		return "", nil, fmt.Errorf("%s not in pack %s", oid, pf.packPath)
+	}
+	f, err := os.Open(pf.packPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	return pf.readAtOffset(f, pf.offsets[idx])
+}
+
+func (pf *packFile) readAtOffset(f *os.File, offset uint64) (objType string, content []byte, err error) {
+	typeTag, size, headerLen, err := readPackObjHeader(f, offset)
+	if err != nil {
+		return "", nil, err
+	}
+	bodyOffset := offset + uint64(headerLen)
+	switch typeTag {
+	case packObjCommit, packObjTree, packObjBlob, packObjTag:
+		data, err := inflateAt(f, bodyOffset, int64(size))
+		if err != nil {
+			return "", nil, err
+		}
+		return packTypeNames[typeTag], data, nil
+	case packObjOfsDelta:
+		baseRelOffset, n, err := readOffsetDeltaBase(f, bodyOffset)
+		if err != nil {
+			return "", nil, err
+		}
+		deltaStart := bodyOffset + uint64(n)
+		delta, err := inflateAt(f, deltaStart, -1)
+		if err != nil {
+			return "", nil, err
+		}
+		baseType, baseContent, err := pf.readAtOffset(f, offset-baseRelOffset)
+		if err != nil {
+			return "", nil, err
+		}
+		merged, err := applyDelta(baseContent, delta)
+		if err != nil {
+			return "", nil, err
+		}
+		return baseType, merged, nil
+	case packObjRefDelta:
+		baseSHA := make([]byte, pf.idSize)
+		if _, err := f.ReadAt(baseSHA, int64(bodyOffset)); err != nil {
+			return "", nil, err
+		}
+		delta, err := inflateAt(f, bodyOffset+uint64(pf.idSize), -1)
+		if err != nil {
+			return "", nil, err
+		}
+		baseType, baseContent, err := pf.readObject(ObjectID(fmt.Sprintf("%x", baseSHA)))
+		if err != nil {
+			return "", nil, err
+		}
+		merged, err := applyDelta(baseContent, delta)
+		if err != nil {
+			return "", nil, err
+		}
+		return baseType, merged, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported pack object type %d", typeTag)
+	}
+}
+
+// readPackObjHeader decodes the variable-length (type, size) header that
+// precedes every packed object, returning the type tag, uncompressed size,
+// and the number of header bytes consumed.
+func readPackObjHeader(f *os.File, offset uint64) (typeTag int, size uint64, headerLen int, err error) {
+	buf := make([]byte, 1)
+	if _, err = f.ReadAt(buf, int64(offset)); err != nil {
+		return
+	}
+	b := buf[0]
+	typeTag = int(b>>4) & 0x7
+	size = uint64(b & 0xf)
+	shift := uint(4)
+	headerLen = 1
+	for b&0x80 != 0 {
+		if _, err = f.ReadAt(buf, int64(offset)+int64(headerLen)); err != nil {
+			return
+		}
+		b = buf[0]
+		size |= uint64(b&0x7f) << shift
+		shift += 7
+		headerLen++
+	}
+	return
+}
+
+// readOffsetDeltaBase decodes the base-128 negative offset used by
+// OBJ_OFS_DELTA objects to point back at their base within the same pack.
+func readOffsetDeltaBase(f *os.File, offset uint64) (rel uint64, consumed int, err error) {
+	buf := make([]byte, 1)
+	if _, err = f.ReadAt(buf, int64(offset)); err != nil {
+		return
+	}
+	b := buf[0]
+	rel = uint64(b & 0x7f)
+	consumed = 1
+	for b&0x80 != 0 {
+		if _, err = f.ReadAt(buf, int64(offset)+int64(consumed)); err != nil {
+			return
+		}
+		b = buf[0]
+		rel = ((rel + 1) << 7) | uint64(b&0x7f)
+		consumed++
+	}
+	return
+}
+
+// inflateAt zlib-decompresses the stream starting at offset. If
+// expectedSize is non-negative, reading stops once that many bytes have
+// been produced; otherwise it reads until the zlib stream ends.
+func inflateAt(f *os.File, offset uint64, expectedSize int64) ([]byte, error) {
+	sr := &sectionReader{f: f, pos: int64(offset)}
+	zr, err := zlib.NewReader(sr)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	if expectedSize >= 0 {
+		buf := make([]byte, expectedSize)
+		_, err := io.ReadFull(zr, buf)
+		return buf, err
+	}
+	return ioutil.ReadAll(zr)
+}
+
+// sectionReader reads from f starting at pos, advancing pos on every read.
+// It exists because we only know a pack object's compressed length after
+// decompressing it, so we hand zlib an open-ended stream instead of a
+// pre-sliced io.SectionReader.
+type sectionReader struct {
+	f   *os.File
+	pos int64
+}
+
+func (s *sectionReader) Read(p []byte) (int, error) {
+	n, err := s.f.ReadAt(p, s.pos)
+	s.pos += int64(n)
+	return n, err
+}
+
+// applyDelta reconstructs a full object from a base object and a Git pack
+// delta, per the copy/insert instruction format documented in
+// Documentation/technical/pack-format.txt.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	srcSize, n := readDeltaVarint(delta)
+	delta = delta[n:]
+	if uint64(len(base)) != srcSize {
+		return nil, fmt.Errorf("delta base size mismatch: have %d, want %d", len(base), srcSize)
+	}
+	targetSize, n := readDeltaVarint(delta)
+	delta = delta[n:]
+
+	out := make([]byte, 0, targetSize)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		if op&0x80 != 0 {
+			var offset, size uint32
+			if op&0x01 != 0 {
+				offset |= uint32(delta[0])
+				delta = delta[1:]
+			}
+			if op&0x02 != 0 {
+				offset |= uint32(delta[0]) << 8
+				delta = delta[1:]
+			}
+			if op&0x04 != 0 {
+				offset |= uint32(delta[0]) << 16
+				delta = delta[1:]
+			}
+			if op&0x08 != 0 {
+				offset |= uint32(delta[0]) << 24
+				delta = delta[1:]
+			}
+			if op&0x10 != 0 {
+				size |= uint32(delta[0])
+				delta = delta[1:]
+			}
+			if op&0x20 != 0 {
+				size |= uint32(delta[0]) << 8
+				delta = delta[1:]
+			}
+			if op&0x40 != 0 {
+				size |= uint32(delta[0]) << 16
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if int(offset)+int(size) > len(base) {
+				return nil, fmt.Errorf("delta copy instruction out of range")
+			}
+			out = append(out, base[offset:offset+size]...)
+		} else if op != 0 {
+			n := int(op)
+			if n > len(delta) {
+				return nil, fmt.Errorf("delta insert instruction out of range")
+			}
+			out = append(out, delta[:n]...)
+			delta = delta[n:]
+		} else {
+			return nil, fmt.Errorf("invalid delta opcode 0")
+		}
+	}
+	if uint64(len(out)) != targetSize {
+		return nil, fmt.Errorf("delta target size mismatch: produced %d, want %d", len(out), targetSize)
+	}
+	return out, nil
+}
+
+// readDeltaVarint reads the little-endian, base-128 varint used to encode
+// the source/target sizes at the start of a delta.
+func readDeltaVarint(b []byte) (v uint64, consumed int) {
+	shift := uint(0)
+	for _, c := range b {
+		v |= uint64(c&0x7f) << shift
+		consumed++
+		shift += 7
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	return
+}
@@ -2,15 +2,81 @@ package git
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 )
 
+// RefType identifies what kind of thing a Ref points at, so callers can
+// switch on ref kind instead of doing their own prefix matching.
+type RefType int
+
+const (
+	// OtherRef is a ref whose path does not match any of the well-known
+	// namespaces below (or a raw SHA that is not a ref at all).
+	OtherRef RefType = iota
+	LocalBranch
+	RemoteBranch
+	LocalTag
+	RemoteTag
+	HeadRef
+	StashRef
+)
+
+// Prefix returns the ref-namespace prefix that this RefType lives under,
+// and whether it has one at all (HEAD and OtherRef do not).
+func (t RefType) Prefix() (prefix string, hasPrefix bool) {
+	switch t {
+	case LocalBranch:
+		return "refs/heads/", true
+	case RemoteBranch:
+		return "refs/remotes/", true
+	case LocalTag:
+		return "refs/tags/", true
+	case RemoteTag:
+		return "refs/remotes/", true
+	case StashRef:
+		return "refs/stash", true
+	default:
+		return "", false
+	}
+}
+
+// refTypeForPath classifies a ref path the way `load_refs` sees them coming
+// back from `git show-ref`.
+func refTypeForPath(path string) RefType {
+	switch {
+	case path == "HEAD":
+		return HeadRef
+	case path == "refs/stash":
+		return StashRef
+	case strings.HasPrefix(path, "refs/heads/"):
+		return LocalBranch
+	case strings.HasPrefix(path, "refs/tags/"):
+		return LocalTag
+	case strings.HasPrefix(path, "refs/remotes/"):
+		rest := strings.TrimPrefix(path, "refs/remotes/")
+		if idx := strings.Index(rest, "/"); idx >= 0 && strings.HasPrefix(rest[idx+1:], "tags/") {
+			return RemoteTag
+		}
+		return RemoteBranch
+	default:
+		return OtherRef
+	}
+}
+
 // Refs are the basic way to point at an individual commit in Git.
 type Ref struct {
-	SHA, Path string
-	r         *Repo
+	SHA  ObjectID
+	Path string
+	Type RefType
+	r    *Repo
+}
+
+// Prefix is a shortcut for r.Type.Prefix().
+func (r *Ref) Prefix() (prefix string, hasPrefix bool) {
+	return r.Type.Prefix()
 }
 
 // Test to see if this ref points a a local ref.
@@ -40,7 +106,7 @@ func (r *Ref) IsHead() bool {
 }
 
 func (r *Ref) IsRaw() bool {
-	return r.SHA == r.Path
+	return string(r.SHA) == r.Path
 }
 
 // Get the name of the current ref.
@@ -74,7 +140,10 @@ func (r *Ref) Delete() (err error) {
 	cmd, _, _ := r.r.Git(c, "-d", r.Name())
 	err = cmd.Run()
 	if err == nil {
+		r.r.mu.Lock()
 		delete(r.r.refs, r.Name())
+		r.r.revCache = nil
+		r.r.mu.Unlock()
 	}
 	return
 }
@@ -94,7 +163,9 @@ func (r *Ref) RemoteBranch(remote string) (res *Ref, err error) {
 	if !r.IsLocal() {
 		return nil,fmt.Errorf("%s is not a branch, cannot find remote tracking branch.\n",r.Path)
 	}
-	res,found := r.r.refs["refs/remotes/"+remote+"/"+r.Name()]
+	r.r.mu.RLock()
+	res, found := r.r.refs["refs/remotes/"+remote+"/"+r.Name()]
+	r.r.mu.RUnlock()
 	if !found {
 		return nil,fmt.Errorf("%s has no remote branch at %s\n",r.Path,remote)
 	}
@@ -104,13 +175,19 @@ func (r *Ref) RemoteBranch(remote string) (res *Ref, err error) {
 // Test to see if other is reachable in the commit
 // history leading up to this ref.
 func (r *Ref) Contains(other *Ref) (bool, error) {
+	return r.ContainsContext(context.Background(), other)
+}
+
+// ContainsContext is like Contains, but binds the underlying 'git rev-list'
+// to ctx so callers can enforce a deadline or cancellation.
+func (r *Ref) ContainsContext(ctx context.Context, other *Ref) (bool, error) {
 	// A ref ls always reachable from itself.
 	if r.SHA == other.SHA {
 		return true, nil
 	}
 	// If other's revision graph has revs that are not in our revision
 	// graph, then we do not contain other.
-	cmd, out, _ := r.r.Git("rev-list", other.SHA, fmt.Sprintf("^%s", r.SHA))
+	cmd, out, _ := r.r.GitContext(ctx, "rev-list", string(other.SHA), fmt.Sprintf("^%s", r.SHA))
 	if err := cmd.Run(); err != nil {
 		return false, err
 	}
@@ -119,11 +196,20 @@ func (r *Ref) Contains(other *Ref) (bool, error) {
 	return (out.Len() == 0), nil
 }
 
-// Test to see if a ref exists.
+// Test to see if a ref exists. Besides literal ref names, this also
+// recognizes abbreviated or full raw object ids by falling back to
+// RevParse, so it agrees with whatever HasRef's callers pass to Ref or
+// RevParse.
 func (r *Repo) HasRef(ref string) bool {
 	r.load_refs()
-	_, err := r.refs[ref]
-	return err
+	r.mu.RLock()
+	_, ok := r.refs[ref]
+	r.mu.RUnlock()
+	if ok {
+		return true
+	}
+	_, err := r.RevParse(ref)
+	return err == nil
 }
 
 func (r *Ref) HasRemoteRef(remote string) (ok bool) {
@@ -159,25 +245,40 @@ func (r *Ref) TrackRemote(remote string) (err error) {
 // Given a string that should represent a ref, return that ref or an error.
 func (r *Repo) Ref(ref string) (res *Ref, err error) {
 	r.load_refs()
-	for _, prefix := range []string{"", "refs/heads/", "refs/tags", "refs/remotes"} {
-		refname := prefix + ref
-		if res = r.refs[refname]; res != nil {
-			return res, nil
+	r.mu.RLock()
+	if res = r.refs[ref]; res == nil {
+		for _, t := range []RefType{LocalBranch, LocalTag, RemoteBranch} {
+			prefix, _ := t.Prefix()
+			if res = r.refs[prefix+ref]; res != nil {
+				break
+			}
 		}
 	}
+	r.mu.RUnlock()
+	if res != nil {
+		return res, nil
+	}
 	// hmmm... it is not a symbolic ref.  See if it is a raw ref.
 	cmd, _, _ := r.Git("rev-parse", "-q", "--verify", ref)
 	if cmd.Run() != nil {
-		return &Ref{Path: ref, SHA: ref, r: r}, nil
+		return &Ref{Path: ref, SHA: ObjectID(ref), r: r}, nil
 	}
 	return nil, fmt.Errorf("No ref for %s", ref)
 }
 
 func (r *Repo) make_ref(reftype string, name string, base interface{}) (ref *Ref, err error) {
-	r.load_refs()
+	return r.makeRefContext(context.Background(), reftype, name, base)
+}
+
+// makeRefContext is the context-aware counterpart of make_ref.
+func (r *Repo) makeRefContext(ctx context.Context, reftype string, name string, base interface{}) (ref *Ref, err error) {
+	r.loadRefsContext(ctx)
+	r.mu.RLock()
+	exists := r.refs[name] != nil
+	r.mu.RUnlock()
 	if name == "HEAD" {
 		return nil, errors.New("Cannot create a branch named HEAD.")
-	} else if r.refs[name] != nil {
+	} else if exists {
 		return nil, errors.New(name + " already exists.")
 	} else {
 		if !(reftype == "branch" || reftype == "tag") {
@@ -185,10 +286,10 @@ func (r *Repo) make_ref(reftype string, name string, base interface{}) (ref *Ref
 		}
 		switch i := base.(type) {
 		case *Ref:
-			cmd, _, _ := r.Git(reftype, name, i.Name())
+			cmd, _, _ := r.GitContext(ctx, reftype, name, i.Name())
 			err = cmd.Run()
 		case string:
-			cmd, _, _ := r.Git(reftype, name, i)
+			cmd, _, _ := r.GitContext(ctx, reftype, name, i)
 			err = cmd.Run()
 		default:
 			return nil, errors.New("Unknown type for base!")
@@ -197,62 +298,100 @@ func (r *Repo) make_ref(reftype string, name string, base interface{}) (ref *Ref
 			return nil, err
 		}
 	}
-	r.refs = nil
-	r.load_refs()
+	r.ReloadRefs()
+	r.loadRefsContext(ctx)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.refs[name], nil
 }
 
 // Create a branch
 func (r *Repo) Branch(name string, base interface{}) (ref *Ref, err error) {
-	ref, err = r.make_ref("branch", name, base)
-	return
+	return r.BranchContext(context.Background(), name, base)
+}
+
+// BranchContext is like Branch, but binds the underlying 'git branch' to ctx
+// so callers can enforce a deadline or cancellation.
+func (r *Repo) BranchContext(ctx context.Context, name string, base interface{}) (ref *Ref, err error) {
+	return r.makeRefContext(ctx, "branch", name, base)
 }
 
 // Create a tag
 func (r *Repo) Tag(name string, base interface{}) (ref *Ref, err error) {
-	ref, err = r.make_ref("tag", name, base)
-	return
+	return r.TagContext(context.Background(), name, base)
+}
+
+// TagContext is like Tag, but binds the underlying 'git tag' to ctx so
+// callers can enforce a deadline or cancellation.
+func (r *Repo) TagContext(ctx context.Context, name string, base interface{}) (ref *Ref, err error) {
+	return r.makeRefContext(ctx, "tag", name, base)
 }
 
 func (r *Ref) Checkout() (err error) {
+	return r.CheckoutContext(context.Background())
+}
+
+// CheckoutContext is like Checkout, but binds the underlying 'git checkout'
+// to ctx so callers can enforce a deadline or cancellation.
+func (r *Ref) CheckoutContext(ctx context.Context) (err error) {
 	var ref string
 	if r.IsLocal() || r.IsTag() {
 		ref = r.Name()
 	} else {
-		ref = r.SHA
+		ref = string(r.SHA)
 	}
-	cmd, _, _ := r.r.Git("checkout", "-q", ref)
+	cmd, _, _ := r.r.GitContext(ctx, "checkout", "-q", ref)
 	err = cmd.Run()
 	return
 }
 
 func (r *Repo) Checkout(ref string) (err error) {
-	cmd, _, _ := r.Git("checkout", "-q", ref)
+	return r.CheckoutContext(context.Background(), ref)
+}
+
+// CheckoutContext is like Checkout, but binds the underlying 'git checkout'
+// to ctx so callers can enforce a deadline or cancellation.
+func (r *Repo) CheckoutContext(ctx context.Context, ref string) (err error) {
+	cmd, _, _ := r.GitContext(ctx, "checkout", "-q", ref)
 	err = cmd.Run()
 	return
 }
 
 func (r *Repo) load_refs() {
-	if r.refs != nil {
+	r.loadRefsContext(context.Background())
+}
+
+// loadRefsContext is the context-aware counterpart of load_refs.
+func (r *Repo) loadRefsContext(ctx context.Context) {
+	r.mu.RLock()
+	loaded := r.refs != nil
+	r.mu.RUnlock()
+	if loaded {
 		return
 	}
 	res := make(map[string]*Ref)
-	cmd, out, err := r.Git("show-ref")
+	cmd, out, err := r.GitContext(ctx, "show-ref")
 	if cmd.Run() != nil {
 		panic(err.String())
 	}
 	scanner := bufio.NewScanner(out)
 	for scanner.Scan() {
 		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
-		ref := &Ref{parts[0], parts[1], r}
+		ref := &Ref{SHA: ObjectID(parts[0]), Path: parts[1], Type: refTypeForPath(parts[1]), r: r}
 		res[ref.Name()] = ref
 	}
+	r.mu.Lock()
 	r.refs = res
+	r.mu.Unlock()
 }
 
-// Reload all the refs lazily.
+// Reload all the refs lazily. This also drops any cached RevParse results,
+// since they may have been resolved against refs that just moved.
 func (r *Repo) ReloadRefs() {
+	r.mu.Lock()
 	r.refs = nil
+	r.revCache = nil
+	r.mu.Unlock()
 }
 
 
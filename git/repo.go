@@ -6,6 +6,7 @@ package git
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -13,6 +14,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 // ConfigMap maps config keys to their values.
@@ -27,10 +29,43 @@ type Repo struct {
 	GitDir string
 	// WorkDir is the directory that holds the working tree for this repo.
 	WorkDir string
+	// HashAlgo is the hash algorithm this repo's object database was
+	// created with. It is detected from extensions.objectFormat on Open.
+	HashAlgo HashAlgo
+
+	// mu guards refs, cfg, and revCache so a Repo can be shared between
+	// goroutines.
+	mu sync.RWMutex
 	// refs holds the cached RefMap.
 	refs RefMap
 	// cfg holds the cached config data.
 	cfg ConfigMap
+	// revCache memoizes resolved rev-parse specs to the SHA they resolved to.
+	revCache map[string]ObjectID
+	// env holds extra environment variables applied to every git command
+	// this Repo runs, on top of the process's own. Set via WithEnv.
+	env map[string]string
+}
+
+// WithEnv returns a new Repo that points at the same git/work dirs as r but
+// applies env on top of the process environment (and on top of any env r
+// itself carries) for every command it runs. r is left untouched, so
+// WithEnv is safe to call from multiple goroutines sharing r.
+//
+// This is useful for per-call overrides like GIT_TERMINAL_PROMPT=0,
+// GIT_SSH_COMMAND=..., or GIT_LFS_SKIP_SMUDGE=1.
+func (r *Repo) WithEnv(env map[string]string) *Repo {
+	r.mu.RLock()
+	merged := make(map[string]string, len(r.env)+len(env))
+	for k, v := range r.env {
+		merged[k] = v
+	}
+	hashAlgo := r.HashAlgo
+	r.mu.RUnlock()
+	for k, v := range env {
+		merged[k] = v
+	}
+	return &Repo{GitDir: r.GitDir, WorkDir: r.WorkDir, HashAlgo: hashAlgo, env: merged}
 }
 
 var gitCmd string
@@ -97,6 +132,7 @@ func Open(path string) (repo *Repo, err error) {
 			repo = new(Repo)
 			repo.GitDir = gitdir
 			repo.WorkDir = workdir
+			repo.HashAlgo = detectHashAlgo(repo)
 			return
 		}
 		parent := filepath.Dir(path)
@@ -108,13 +144,34 @@ func Open(path string) (repo *Repo, err error) {
 	return nil, errors.New(fmt.Sprintf("Could not find a Git repository in %s or any of its parents!", basepath))
 }
 
+// detectHashAlgo looks at extensions.objectFormat to figure out whether repo
+// is a SHA-1 or SHA-256 repository. Repositories that do not set it (the
+// vast majority, today) are SHA-1.
+func detectHashAlgo(repo *Repo) HashAlgo {
+	cmd, out, _ := repo.Git("config", "--get", "extensions.objectFormat")
+	if cmd.Run() != nil {
+		return SHA1
+	}
+	if strings.TrimSpace(out.String()) == "sha256" {
+		return SHA256
+	}
+	return SHA1
+}
+
 // Git is a helper for creating exec.Cmd types and arranging to capture
 // the output and erro streams of the command into bytes.Buffers
 func Git(cmd string, args ...string) (res *exec.Cmd, stdout, stderr *bytes.Buffer) {
+	return GitContext(context.Background(), cmd, args...)
+}
+
+// GitContext is the context-aware counterpart of Git, for use before a Repo
+// exists yet (Init, Clone). The returned *exec.Cmd is bound to ctx, so
+// callers can enforce a deadline or cancel it outright.
+func GitContext(ctx context.Context, cmd string, args ...string) (res *exec.Cmd, stdout, stderr *bytes.Buffer) {
 	cmdArgs := make([]string, 1)
 	cmdArgs[0] = cmd
 	cmdArgs = append(cmdArgs, args...)
-	res = exec.Command(gitCmd, cmdArgs...)
+	res = exec.CommandContext(ctx, gitCmd, cmdArgs...)
 	stdout, stderr = new(bytes.Buffer), new(bytes.Buffer)
 	res.Stdout, res.Stderr = stdout, stderr
 	return
@@ -122,21 +179,43 @@ func Git(cmd string, args ...string) (res *exec.Cmd, stdout, stderr *bytes.Buffe
 
 // Git is a helper for making sure that the Git command runs in the proper repository.
 func (r *Repo) Git(cmd string, args ...string) (res *exec.Cmd, out, err *bytes.Buffer) {
+	return r.GitContext(context.Background(), cmd, args...)
+}
+
+// GitContext is like Git, but binds the resulting *exec.Cmd to ctx so
+// callers can enforce a deadline or cancellation on a per-command basis,
+// and applies any environment overrides set via WithEnv.
+func (r *Repo) GitContext(ctx context.Context, cmd string, args ...string) (res *exec.Cmd, out, err *bytes.Buffer) {
 	var path string
 	if r.WorkDir == "" {
 		path = r.GitDir
 	} else {
 		path = r.WorkDir
 	}
-	res, out, err = Git(cmd, args...)
+	res, out, err = GitContext(ctx, cmd, args...)
 	res.Dir = path
+	r.mu.RLock()
+	if len(r.env) > 0 {
+		environ := os.Environ()
+		for k, v := range r.env {
+			environ = append(environ, k+"="+v)
+		}
+		res.Env = environ
+	}
+	r.mu.RUnlock()
 	return
 }
 
 // Init initializes new Get metadata at the passed path.
 // The rest of the args are passed to the 'git init' command unchanged.
 func Init(path string, args ...string) (res *Repo, err error) {
-	cmd, _, stderr := Git("init", append(args, path)...)
+	return InitContext(context.Background(), path, args...)
+}
+
+// InitContext is like Init, but binds the underlying 'git init' to ctx so
+// callers can enforce a deadline or cancellation.
+func InitContext(ctx context.Context, path string, args ...string) (res *Repo, err error) {
+	cmd, _, stderr := GitContext(ctx, "init", append(args, path)...)
 	if err = cmd.Run(); err != nil {
 		return nil, errors.New(stderr.String())
 	}
@@ -147,7 +226,13 @@ func Init(path string, args ...string) (res *Repo, err error) {
 // Clone a new git repository.  The clone will be created in the current
 // directory.
 func Clone(source, target string, args ...string) (res *Repo, err error) {
-	cmd, _, stderr := Git("clone", append(args, source, target)...)
+	return CloneContext(context.Background(), source, target, args...)
+}
+
+// CloneContext is like Clone, but binds the underlying 'git clone' to ctx so
+// callers can enforce a deadline or cancellation.
+func CloneContext(ctx context.Context, source, target string, args ...string) (res *Repo, err error) {
+	cmd, _, stderr := GitContext(ctx, "clone", append(args, source, target)...)
 	if err = cmd.Run(); err != nil {
 		return nil, errors.New(stderr.String())
 	}
@@ -176,9 +261,9 @@ func (s *StatLine) Print() string {
 	return res
 }
 
-func (r *Repo) mapStatus() (res StatLines) {
+func (r *Repo) mapStatus(ctx context.Context) (res StatLines) {
 	var thisStat *StatLine
-	cmd, out, err := r.Git("status", "--porcelain", "-z")
+	cmd, out, err := r.GitContext(ctx, "status", "--porcelain", "-z")
 	if cmd.Run() != nil {
 		panic(err.String())
 	}
@@ -211,7 +296,13 @@ func (r *Repo) mapStatus() (res StatLines) {
 
 // IsClean checks to see if there are any uncomitted or untracked changes.
 func (r *Repo) IsClean() (res bool, lines StatLines) {
-	lines = r.mapStatus()
+	return r.IsCleanContext(context.Background())
+}
+
+// IsCleanContext is like IsClean, but binds the underlying 'git status' to
+// ctx so callers can enforce a deadline or cancellation.
+func (r *Repo) IsCleanContext(ctx context.Context) (res bool, lines StatLines) {
+	lines = r.mapStatus(ctx)
 	res = len(lines) == 0
 	return
 }
@@ -0,0 +1,66 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+)
+
+// REF_BEFORE_FIRST_COMMIT is the SHA of the canonical empty tree object.
+// It is not a real ref -- nothing ever points at it in show-ref output --
+// but it is useful as a stand-in "before" side when diffing against a
+// repository that does not have a first commit yet.
+const REF_BEFORE_FIRST_COMMIT = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// RevParse resolves spec using the same revision grammar that
+// `git rev-parse` understands: HEAD@{n}, <ref>~N, <ref>^N, <ref>@{upstream},
+// <ref>@{push}, :/<text> commit message searches, abbreviated OIDs, and
+// plain ref names are all accepted. Resolved SHAs are cached on the Repo,
+// so calling RevParse with the same spec twice only shells out once.
+func (r *Repo) RevParse(spec string) (res *Ref, err error) {
+	if spec == REF_BEFORE_FIRST_COMMIT {
+		return &Ref{SHA: REF_BEFORE_FIRST_COMMIT, Path: REF_BEFORE_FIRST_COMMIT, r: r}, nil
+	}
+	r.mu.RLock()
+	sha, ok := r.revCache[spec]
+	r.mu.RUnlock()
+	if ok {
+		return r.refForSHA(sha), nil
+	}
+	cmd, out, stderr := r.Git("rev-parse", "--verify", "-q", spec)
+	if cmd.Run() != nil {
+		return nil, fmt.Errorf("No revision for %s: %s", spec, strings.TrimSpace(stderr.String()))
+	}
+	sha = ObjectID(strings.TrimSpace(out.String()))
+	r.mu.Lock()
+	if r.revCache == nil {
+		r.revCache = make(map[string]ObjectID)
+	}
+	r.revCache[spec] = sha
+	r.mu.Unlock()
+	return r.refForSHA(sha), nil
+}
+
+// refForSHA finds the symbolic ref (if any) that currently points at sha,
+// falling back to a raw, pathless ref if no symbolic ref does.
+func (r *Repo) refForSHA(sha ObjectID) *Ref {
+	r.load_refs()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, ref := range r.refs {
+		if ref.SHA == sha {
+			return ref
+		}
+	}
+	return &Ref{SHA: sha, Path: string(sha), r: r}
+}
+
+// AbbrevOID returns the first n characters of this ref's SHA. Unlike
+// `git rev-parse --short=n`, it does not lengthen the result to keep it
+// unambiguous. If n is out of range, the full SHA is returned.
+func (r *Ref) AbbrevOID(n int) string {
+	sha := string(r.SHA)
+	if n <= 0 || n > len(sha) {
+		return sha
+	}
+	return sha[:n]
+}